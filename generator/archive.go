@@ -0,0 +1,225 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+)
+
+// archiveEntrySep separates an archive path from the path of an entry
+// inside it, e.g. "vendor/firmware.tar.zst!/iwlwifi-9000.ucode".
+const archiveEntrySep = "!"
+
+// splitArchivePath reports whether fn uses the "archive!/inner/path"
+// syntax and, if so, splits it into the archive path and the path of the
+// entry requested from inside it.
+func splitArchivePath(fn string) (archivePath, innerPath string, ok bool) {
+	idx := strings.IndexByte(fn, archiveEntrySep[0])
+	if idx < 0 {
+		return "", "", false
+	}
+	return fn[:idx], fn[idx+1:], true
+}
+
+type archiveKind int
+
+const (
+	archiveUnknown archiveKind = iota
+	archiveZip
+	archiveTar
+	archiveTarGz
+	archiveTarXz
+	archiveTarZst
+)
+
+// detectArchiveKind sniffs the container format from its magic bytes.
+// Plain tar has no magic number at offset 0, so it is recognized by its
+// ".tar" extension instead.
+func detectArchiveKind(fn string) (archiveKind, error) {
+	f, err := os.Open(fn)
+	if err != nil {
+		return archiveUnknown, err
+	}
+	defer f.Close()
+
+	magic := make([]byte, 6)
+	n, err := io.ReadFull(f, magic)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return archiveUnknown, err
+	}
+	magic = magic[:n]
+
+	switch {
+	case bytes.HasPrefix(magic, []byte("PK\x03\x04")), bytes.HasPrefix(magic, []byte("PK\x05\x06")):
+		return archiveZip, nil
+	case bytes.HasPrefix(magic, []byte{0x1f, 0x8b}):
+		return archiveTarGz, nil
+	case bytes.HasPrefix(magic, []byte{0xfd, '7', 'z', 'X', 'Z', 0x00}):
+		return archiveTarXz, nil
+	case bytes.HasPrefix(magic, []byte{0x28, 0xb5, 0x2f, 0xfd}):
+		return archiveTarZst, nil
+	case strings.HasSuffix(fn, ".tar"):
+		return archiveTar, nil
+	default:
+		return archiveUnknown, fmt.Errorf("detectArchiveKind: %s: unrecognized archive format", fn)
+	}
+}
+
+// AppendFromArchive extracts innerPath from archivePath (a .zip, .tar,
+// .tar.gz, .tar.xz or .tar.zst archive, detected by magic bytes) and
+// streams it into the image as dest, without extracting the rest of the
+// archive to disk.
+func (img *Image) AppendFromArchive(archivePath, innerPath, dest string) error {
+	kind, err := detectArchiveKind(archivePath)
+	if err != nil {
+		return fmt.Errorf("AppendFromArchive: %v", err)
+	}
+
+	f, err := os.Open(archivePath)
+	if err != nil {
+		return fmt.Errorf("AppendFromArchive: %v", err)
+	}
+	defer f.Close()
+
+	innerPath = strings.TrimPrefix(innerPath, "/")
+
+	var (
+		content []byte
+		mode    os.FileMode
+	)
+	switch kind {
+	case archiveZip:
+		content, mode, err = readZipEntry(f, innerPath)
+	case archiveTar, archiveTarGz, archiveTarXz, archiveTarZst:
+		content, mode, err = readTarEntry(f, kind, innerPath)
+	default:
+		err = fmt.Errorf("unsupported archive format")
+	}
+	if err != nil {
+		return fmt.Errorf("AppendFromArchive: %s%s%s: %v", archivePath, archiveEntrySep, innerPath, err)
+	}
+
+	if err := img.AppendContent(content, mode.Perm(), dest); err != nil {
+		return fmt.Errorf("AppendFromArchive: %v", err)
+	}
+	return nil
+}
+
+func readZipEntry(f *os.File, innerPath string) ([]byte, os.FileMode, error) {
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, 0, err
+	}
+	zr, err := zip.NewReader(f, fi.Size())
+	if err != nil {
+		return nil, 0, err
+	}
+
+	for _, zf := range zr.File {
+		if strings.TrimPrefix(zf.Name, "/") != innerPath {
+			continue
+		}
+		if !zf.Mode().IsRegular() {
+			return nil, 0, fmt.Errorf("%s: not a regular file (mode %v)", innerPath, zf.Mode())
+		}
+		rc, err := zf.Open()
+		if err != nil {
+			return nil, 0, err
+		}
+		defer rc.Close()
+		content, err := ioutil.ReadAll(rc)
+		if err != nil {
+			return nil, 0, err
+		}
+		return content, zf.Mode(), nil
+	}
+	return nil, 0, fmt.Errorf("entry not found in zip archive")
+}
+
+// nopCloser adapts a reader with no Close of its own (or one whose Close
+// is left to the caller, like the *os.File passed to tarDecompressor) to
+// io.Closer.
+type nopCloser struct{}
+
+func (nopCloser) Close() error { return nil }
+
+// zstdDecoderCloser adapts *zstd.Decoder.Close, which returns nothing, to
+// io.Closer. Closing it is required to stop the decoder's background
+// goroutines -- skipping it leaks them for every .tar.zst archive or
+// zstd-compressed OCI layer read.
+type zstdDecoderCloser struct{ d *zstd.Decoder }
+
+func (c zstdDecoderCloser) Close() error {
+	c.d.Close()
+	return nil
+}
+
+// tarDecompressor wraps f with the decompressor kind calls for, so the
+// returned reader yields a plain tar stream regardless of what the tar
+// itself was packaged in. The returned io.Closer must always be closed by
+// the caller once done reading; for kinds that need no decompression it is
+// a no-op.
+func tarDecompressor(f *os.File, kind archiveKind) (io.Reader, io.Closer, error) {
+	switch kind {
+	case archiveTarGz:
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			return nil, nil, err
+		}
+		return gz, gz, nil
+	case archiveTarXz:
+		xr, err := xz.NewReader(f)
+		if err != nil {
+			return nil, nil, err
+		}
+		return xr, nopCloser{}, nil
+	case archiveTarZst:
+		zr, err := zstd.NewReader(f)
+		if err != nil {
+			return nil, nil, err
+		}
+		return zr, zstdDecoderCloser{zr}, nil
+	default:
+		return f, nopCloser{}, nil
+	}
+}
+
+func readTarEntry(f *os.File, kind archiveKind, innerPath string) ([]byte, os.FileMode, error) {
+	r, c, err := tarDecompressor(f, kind)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer c.Close()
+
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, 0, err
+		}
+		if strings.TrimPrefix(hdr.Name, "/") != innerPath {
+			continue
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			return nil, 0, fmt.Errorf("%s: not a regular file (tar type %q)", innerPath, string(hdr.Typeflag))
+		}
+		content, err := ioutil.ReadAll(tr)
+		if err != nil {
+			return nil, 0, err
+		}
+		return content, os.FileMode(hdr.Mode), nil
+	}
+	return nil, 0, fmt.Errorf("entry not found in tar archive")
+}
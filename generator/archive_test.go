@@ -0,0 +1,205 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+func TestSplitArchivePath(t *testing.T) {
+	cases := []struct {
+		in, archive, inner string
+		ok                 bool
+	}{
+		{"vendor/firmware.tar.zst!/iwlwifi-9000.ucode", "vendor/firmware.tar.zst", "/iwlwifi-9000.ucode", true},
+		{"plain/path", "", "", false},
+	}
+	for _, c := range cases {
+		archive, inner, ok := splitArchivePath(c.in)
+		if archive != c.archive || inner != c.inner || ok != c.ok {
+			t.Errorf("splitArchivePath(%q) = %q, %q, %v; want %q, %q, %v", c.in, archive, inner, ok, c.archive, c.inner, c.ok)
+		}
+	}
+}
+
+func writeTempFile(t *testing.T, name string, content []byte) string {
+	t.Helper()
+	fn := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(fn, content, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return fn
+}
+
+func TestDetectArchiveKind(t *testing.T) {
+	var zipBuf bytes.Buffer
+	zw := zip.NewWriter(&zipBuf)
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	var gzBuf bytes.Buffer
+	gz := gzip.NewWriter(&gzBuf)
+	gz.Write([]byte("x"))
+	gz.Close()
+
+	var zstBuf bytes.Buffer
+	zw2, err := zstd.NewWriter(&zstBuf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	zw2.Write([]byte("x"))
+	zw2.Close()
+
+	cases := []struct {
+		name    string
+		content []byte
+		want    archiveKind
+	}{
+		{"a.zip", zipBuf.Bytes(), archiveZip},
+		{"a.tar.gz", gzBuf.Bytes(), archiveTarGz},
+		{"a.tar.zst", zstBuf.Bytes(), archiveTarZst},
+		{"a.tar", []byte("not actually a tar but has the right extension"), archiveTar},
+	}
+	for _, c := range cases {
+		fn := writeTempFile(t, c.name, c.content)
+		got, err := detectArchiveKind(fn)
+		if err != nil {
+			t.Errorf("detectArchiveKind(%s): %v", c.name, err)
+			continue
+		}
+		if got != c.want {
+			t.Errorf("detectArchiveKind(%s) = %v, want %v", c.name, got, c.want)
+		}
+	}
+
+	fn := writeTempFile(t, "unknown.bin", []byte("garbage"))
+	if _, err := detectArchiveKind(fn); err == nil {
+		t.Error("detectArchiveKind(unknown.bin) unexpectedly succeeded")
+	}
+}
+
+func buildTestZip(t *testing.T, files map[string]string, symlinks map[string]string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for name, content := range files {
+		w, err := zw.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write([]byte(content))
+	}
+	for name, target := range symlinks {
+		fh := &zip.FileHeader{Name: name}
+		fh.SetMode(os.ModeSymlink | 0777)
+		w, err := zw.CreateHeader(fh)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write([]byte(target))
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestReadZipEntry(t *testing.T) {
+	data := buildTestZip(t, map[string]string{"bin/busybox": "binary content"}, map[string]string{"bin/sh": "busybox"})
+	fn := writeTempFile(t, "a.zip", data)
+	f, err := os.Open(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	content, _, err := readZipEntry(f, "bin/busybox")
+	if err != nil {
+		t.Fatalf("readZipEntry: %v", err)
+	}
+	if string(content) != "binary content" {
+		t.Errorf("content = %q, want %q", content, "binary content")
+	}
+
+	if _, _, err := readZipEntry(f, "bin/sh"); err == nil {
+		t.Error("readZipEntry on a symlink entry unexpectedly succeeded")
+	}
+
+	if _, _, err := readZipEntry(f, "does/not/exist"); err == nil {
+		t.Error("readZipEntry on a missing entry unexpectedly succeeded")
+	}
+}
+
+func buildTestTar(t *testing.T, files map[string]string, symlinks map[string]string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for name, content := range files {
+		hdr := &tar.Header{Name: name, Mode: 0644, Size: int64(len(content)), Typeflag: tar.TypeReg}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		tw.Write([]byte(content))
+	}
+	for name, target := range symlinks {
+		hdr := &tar.Header{Name: name, Mode: 0777, Typeflag: tar.TypeSymlink, Linkname: target}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestReadTarEntryPlainAndGz(t *testing.T) {
+	raw := buildTestTar(t, map[string]string{"bin/busybox": "binary content"}, map[string]string{"bin/sh": "busybox"})
+
+	var gzBuf bytes.Buffer
+	gz := gzip.NewWriter(&gzBuf)
+	gz.Write(raw)
+	if err := gz.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		name string
+		data []byte
+		kind archiveKind
+	}{
+		{"plain", raw, archiveTar},
+		{"gzip", gzBuf.Bytes(), archiveTarGz},
+	}
+	for _, c := range cases {
+		fn := writeTempFile(t, c.name+".tar", c.data)
+
+		openFresh := func() *os.File {
+			f, err := os.Open(fn)
+			if err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(func() { f.Close() })
+			return f
+		}
+
+		content, _, err := readTarEntry(openFresh(), c.kind, "bin/busybox")
+		if err != nil {
+			t.Fatalf("[%s] readTarEntry: %v", c.name, err)
+		}
+		if string(content) != "binary content" {
+			t.Errorf("[%s] content = %q, want %q", c.name, content, "binary content")
+		}
+
+		if _, _, err := readTarEntry(openFresh(), c.kind, "bin/sh"); err == nil {
+			t.Errorf("[%s] readTarEntry on a symlink entry unexpectedly succeeded", c.name)
+		}
+	}
+}
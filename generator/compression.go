@@ -0,0 +1,105 @@
+package main
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/pierrec/lz4/v4"
+	"github.com/ulikunitz/xz"
+)
+
+// Compression selects the codec used to compress the generated cpio
+// archive. The kernel's initramfs unpacker only understands whatever
+// CONFIG_RD_* decompressors it was built with, so callers integrating
+// booster into their own build pipeline need to be able to match it.
+type Compression int
+
+const (
+	CompressionZstd Compression = iota
+	CompressionGzip
+	CompressionXz
+	CompressionLz4
+	CompressionNone
+)
+
+// String implements fmt.Stringer, so a Compression can be used directly
+// as a flag.Value's backing representation.
+func (c Compression) String() string {
+	switch c {
+	case CompressionGzip:
+		return "gzip"
+	case CompressionXz:
+		return "xz"
+	case CompressionLz4:
+		return "lz4"
+	case CompressionNone:
+		return "none"
+	default:
+		return "zstd"
+	}
+}
+
+// ParseCompression maps a user-facing name (e.g. the value a --compression
+// CLI flag would hold) to a Compression. This package has no main/cmd of
+// its own to register such a flag on; ParseCompression exists so whatever
+// entry point embeds booster can do so with one call:
+//
+//	c, err := ParseCompression(flagValue)
+//	img, err := NewImage(path, WithCompression(c))
+func ParseCompression(s string) (Compression, error) {
+	switch s {
+	case "", "zstd":
+		return CompressionZstd, nil
+	case "gzip":
+		return CompressionGzip, nil
+	case "xz":
+		return CompressionXz, nil
+	case "lz4":
+		return CompressionLz4, nil
+	case "none":
+		return CompressionNone, nil
+	default:
+		return 0, fmt.Errorf("ParseCompression: unknown compression %q", s)
+	}
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
+
+// newCompressor wraps w with the writer for c, tuned to a high compression
+// level since initramfs images are generated once and decompressed many
+// times. reproducible forces single-threaded encoding where the backend's
+// concurrency would otherwise make block/frame boundaries depend on
+// goroutine scheduling.
+func newCompressor(c Compression, w io.Writer, reproducible bool) (io.WriteCloser, error) {
+	switch c {
+	case CompressionZstd:
+		opts := []zstd.EOption{zstd.WithEncoderLevel(zstd.SpeedBestCompression)}
+		if reproducible {
+			opts = append(opts, zstd.WithEncoderConcurrency(1))
+		}
+		return zstd.NewWriter(w, opts...)
+	case CompressionGzip:
+		return gzip.NewWriterLevel(w, gzip.BestCompression)
+	case CompressionXz:
+		// match the dictionary size `xz -9` uses; the package default is
+		// only 8MiB
+		cfg := xz.WriterConfig{DictCap: 64 << 20}
+		return cfg.NewWriter(w)
+	case CompressionLz4:
+		zw := lz4.NewWriter(w)
+		if err := zw.Apply(lz4.CompressionLevelOption(lz4.Level9)); err != nil {
+			return nil, err
+		}
+		return zw, nil
+	case CompressionNone:
+		return nopWriteCloser{w}, nil
+	default:
+		return nil, fmt.Errorf("newCompressor: unknown compression %v", c)
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/pierrec/lz4/v4"
+	"github.com/ulikunitz/xz"
+)
+
+func TestParseCompression(t *testing.T) {
+	cases := []struct {
+		in   string
+		want Compression
+	}{
+		{"", CompressionZstd},
+		{"zstd", CompressionZstd},
+		{"gzip", CompressionGzip},
+		{"xz", CompressionXz},
+		{"lz4", CompressionLz4},
+		{"none", CompressionNone},
+	}
+	for _, c := range cases {
+		got, err := ParseCompression(c.in)
+		if err != nil {
+			t.Errorf("ParseCompression(%q): %v", c.in, err)
+			continue
+		}
+		if got != c.want {
+			t.Errorf("ParseCompression(%q) = %v, want %v", c.in, got, c.want)
+		}
+		if got.String() != c.want.String() {
+			t.Errorf("%v.String() = %q, want %q", got, got.String(), c.want.String())
+		}
+	}
+
+	if _, err := ParseCompression("bogus"); err == nil {
+		t.Error("ParseCompression(bogus) unexpectedly succeeded")
+	}
+}
+
+func TestNewCompressorRoundTrip(t *testing.T) {
+	const payload = "the quick brown fox jumps over the lazy dog, repeated for compressibility: the quick brown fox jumps over the lazy dog"
+
+	for _, c := range []Compression{CompressionZstd, CompressionGzip, CompressionXz, CompressionLz4, CompressionNone} {
+		var buf bytes.Buffer
+		w, err := newCompressor(c, &buf, false)
+		if err != nil {
+			t.Errorf("newCompressor(%v): %v", c, err)
+			continue
+		}
+		if _, err := w.Write([]byte(payload)); err != nil {
+			t.Errorf("[%v] Write: %v", c, err)
+			continue
+		}
+		if err := w.Close(); err != nil {
+			t.Errorf("[%v] Close: %v", c, err)
+			continue
+		}
+
+		var r interface {
+			Read([]byte) (int, error)
+		}
+		switch c {
+		case CompressionZstd:
+			zr, err := zstd.NewReader(&buf)
+			if err != nil {
+				t.Errorf("[%v] zstd.NewReader: %v", c, err)
+				continue
+			}
+			defer zr.Close()
+			r = zr
+		case CompressionGzip:
+			gz, err := gzip.NewReader(&buf)
+			if err != nil {
+				t.Errorf("[%v] gzip.NewReader: %v", c, err)
+				continue
+			}
+			defer gz.Close()
+			r = gz
+		case CompressionXz:
+			xr, err := xz.NewReader(&buf)
+			if err != nil {
+				t.Errorf("[%v] xz.NewReader: %v", c, err)
+				continue
+			}
+			r = xr
+		case CompressionLz4:
+			r = lz4.NewReader(&buf)
+		case CompressionNone:
+			r = &buf
+		}
+
+		got, err := ioutil.ReadAll(r)
+		if err != nil {
+			t.Errorf("[%v] ReadAll: %v", c, err)
+			continue
+		}
+		if string(got) != payload {
+			t.Errorf("[%v] round-trip content = %q, want %q", c, got, payload)
+		}
+	}
+
+	if _, err := newCompressor(Compression(99), &bytes.Buffer{}, false); err == nil {
+		t.Error("newCompressor(unknown) unexpectedly succeeded")
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDirFS(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(dir, "bin"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "bin", "busybox"), []byte("content"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("busybox", filepath.Join(dir, "bin", "sh")); err != nil {
+		t.Fatal(err)
+	}
+
+	fsys := DirFS(dir)
+
+	fi, err := fsys.Lstat("/bin/busybox")
+	if err != nil {
+		t.Fatalf("Lstat: %v", err)
+	}
+	if fi.Mode()&os.ModeSymlink != 0 {
+		t.Error("bin/busybox reported as a symlink")
+	}
+
+	target, err := fsys.Readlink("/bin/sh")
+	if err != nil {
+		t.Fatalf("Readlink: %v", err)
+	}
+	if target != "busybox" {
+		t.Errorf("Readlink(bin/sh) = %q, want busybox", target)
+	}
+
+	f, err := fsys.Open("/bin/busybox")
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer f.Close()
+	content, err := ioutil.ReadAll(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(content) != "content" {
+		t.Errorf("content = %q, want %q", content, "content")
+	}
+}
+
+func TestTarLayerFS(t *testing.T) {
+	raw := buildTestTar(t, map[string]string{"bin/busybox": "binary content"}, map[string]string{"bin/sh": "busybox"})
+	fn := writeTempFile(t, "layer.tar", raw)
+
+	fsys, err := TarLayerFS(fn)
+	if err != nil {
+		t.Fatalf("TarLayerFS: %v", err)
+	}
+
+	f, err := fsys.Open("/bin/busybox")
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer f.Close()
+	content, err := ioutil.ReadAll(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(content) != "binary content" {
+		t.Errorf("content = %q, want %q", content, "binary content")
+	}
+
+	target, err := fsys.Readlink("/bin/sh")
+	if err != nil {
+		t.Fatalf("Readlink: %v", err)
+	}
+	if target != "busybox" {
+		t.Errorf("Readlink(bin/sh) = %q, want busybox", target)
+	}
+
+	if _, err := fsys.Lstat("/does/not/exist"); err == nil {
+		t.Error("Lstat on a missing entry unexpectedly succeeded")
+	}
+}
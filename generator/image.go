@@ -10,10 +10,10 @@ import (
 	"path"
 	"path/filepath"
 	"strings"
+	"time"
 
 	"github.com/cavaliercoder/go-cpio"
 	"github.com/google/renameio"
-	"github.com/klauspost/compress/zstd"
 )
 
 type Image struct {
@@ -21,9 +21,46 @@ type Image struct {
 	compressor io.Closer
 	out        *cpio.Writer
 	contains   map[string]bool // whether image contains the file
+
+	reproducible    bool
+	sourceDateEpoch time.Time
+	pending         []pendingEntry // buffered entries, only used when reproducible
+}
+
+// ImageOption configures optional behavior of NewImage.
+type ImageOption func(*imageConfig)
+
+type imageConfig struct {
+	compression     Compression
+	reproducible    bool
+	sourceDateEpoch time.Time
+}
+
+// WithCompression selects the compression backend NewImage uses for the
+// cpio archive. The default is zstd.
+func WithCompression(c Compression) ImageOption {
+	return func(cfg *imageConfig) {
+		cfg.compression = c
+	}
+}
+
+// WithReproducible makes NewImage produce a byte-identical image across
+// runs over the same inputs: every entry gets mtime=sourceDateEpoch and
+// uid=gid=0, entries are emitted in lexicographic path order rather than
+// insertion order, and inode numbers are assigned sequentially.
+func WithReproducible(sourceDateEpoch time.Time) ImageOption {
+	return func(cfg *imageConfig) {
+		cfg.reproducible = true
+		cfg.sourceDateEpoch = sourceDateEpoch
+	}
 }
 
-func NewImage(path string) (*Image, error) {
+func NewImage(path string, opts ...ImageOption) (*Image, error) {
+	cfg := imageConfig{compression: CompressionZstd}
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+
 	file, err := renameio.TempFile("", path)
 	if err != nil {
 		return nil, fmt.Errorf("new image: %v", err)
@@ -32,17 +69,19 @@ func NewImage(path string) (*Image, error) {
 		return nil, err
 	}
 
-	compressor, err := zstd.NewWriter(file)
+	compressor, err := newCompressor(cfg.compression, file, cfg.reproducible)
 	if err != nil {
 		return nil, err
 	}
 	out := cpio.NewWriter(compressor)
 
 	return &Image{
-		file:       file,
-		compressor: compressor,
-		out:        out,
-		contains:   make(map[string]bool),
+		file:            file,
+		compressor:      compressor,
+		out:             out,
+		contains:        make(map[string]bool),
+		reproducible:    cfg.reproducible,
+		sourceDateEpoch: cfg.sourceDateEpoch,
 	}, nil
 }
 
@@ -53,6 +92,11 @@ func (img *Image) Cleanup() {
 }
 
 func (img *Image) Close() error {
+	if img.reproducible {
+		if err := img.flushReproducible(); err != nil {
+			return err
+		}
+	}
 	if err := img.out.Close(); err != nil {
 		return err
 	}
@@ -79,14 +123,24 @@ func (img *Image) AppendDir(dir string) error {
 		Name: strings.TrimPrefix(dir, "/"),
 		Mode: cpio.FileMode(0755) | cpio.ModeDir,
 	}
-	if err := img.out.WriteHeader(hdr); err != nil {
+	if err := img.writeEntry(hdr, nil); err != nil {
 		return fmt.Errorf("AppendDir: %v", err)
 	}
 	img.contains[dir] = true
 	return nil
 }
 
+// AppendContent appends content to the image as dest, resolving ELF
+// dependencies (if any) against the live root filesystem. See
+// AppendContentFS to source dependencies from elsewhere.
 func (img *Image) AppendContent(content []byte, mode os.FileMode, dest string) error {
+	return img.AppendContentFS(osFS{}, content, mode, dest)
+}
+
+// AppendContentFS is like AppendContent, but resolves any ELF
+// dependencies content has against fsys instead of the live root
+// filesystem.
+func (img *Image) AppendContentFS(fsys FS, content []byte, mode os.FileMode, dest string) error {
 	if img.contains[dest] {
 		return fmt.Errorf("Trying to add a file %s but it already been added to the image", dest)
 	}
@@ -101,12 +155,9 @@ func (img *Image) AppendContent(content []byte, mode os.FileMode, dest string) e
 		Mode: cpio.FileMode(mode) | cpio.ModeRegular,
 		Size: int64(len(content)),
 	}
-	if err := img.out.WriteHeader(hdr); err != nil {
+	if err := img.writeEntry(hdr, content); err != nil {
 		return fmt.Errorf("AppendFile: %v", err)
 	}
-	if _, err := img.out.Write(content); err != nil {
-		return err
-	}
 	img.contains[dest] = true
 
 	const minimalELFSize = 64 // 64 bytes is a size of 64bit ELF header
@@ -125,62 +176,82 @@ func (img *Image) AppendContent(content []byte, mode os.FileMode, dest string) e
 	}
 	defer ef.Close()
 
-	if err := img.AppendElfDependencies(ef); err != nil {
+	if err := img.AppendElfDependencies(fsys, ef, path.Dir(dest)); err != nil {
 		return fmt.Errorf("AppendFile: %v", err)
 	}
 
 	return nil
 }
 
-// AppendFile appends the file + its dependencies to the ramfs file
+// AppendFile appends the file + its dependencies to the ramfs file,
+// reading it from the live root filesystem. fn may use the
+// "archive!/inner/path" syntax (e.g. "foo.zip!/bin/busybox") to pull an
+// entry out of a zip/tar/tar.gz/tar.xz/tar.zst archive instead; see
+// AppendFromArchive. To source fn from somewhere other than the live root
+// filesystem, use AppendFileFS.
 func (img *Image) AppendFile(fn string) error {
-	fn = path.Clean(fn)
+	if archivePath, innerPath, ok := splitArchivePath(fn); ok {
+		return img.AppendFromArchive(archivePath, innerPath, path.Clean(innerPath))
+	}
+	return img.AppendFileFS(osFS{}, fn, fn)
+}
+
+// AppendFileFS appends src, read from fsys, to the image as dest,
+// following symlinks (and re-adding their targets from fsys) and
+// resolving ELF dependencies against fsys. This is what makes it possible
+// to build an initramfs for a foreign root -- a cross-built staging
+// directory (DirFS) or a container image layer (TarLayerFS) -- without
+// mounting or chrooting into it first.
+func (img *Image) AppendFileFS(fsys FS, src, dest string) error {
+	src = path.Clean(src)
+	dest = path.Clean(dest)
 
-	if err := img.AppendDir(path.Dir(fn)); err != nil {
+	if err := img.AppendDir(path.Dir(dest)); err != nil {
 		return err
 	}
 
-	fi, err := os.Lstat(fn)
+	fi, err := fsys.Lstat(src)
 	if err != nil {
-		return fmt.Errorf("AppendFile: %v", err)
+		return fmt.Errorf("AppendFileFS: %v", err)
 	}
 
 	if fi.Mode()&os.ModeSymlink == os.ModeSymlink {
-		linkTarget, err := os.Readlink(fn)
+		linkTarget, err := fsys.Readlink(src)
 		if err != nil {
-			return fmt.Errorf("AppendFile: %v", err)
+			return fmt.Errorf("AppendFileFS: %v", err)
 		}
 
 		hdr := &cpio.Header{
-			Name: strings.TrimPrefix(fn, "/"),
+			Name: strings.TrimPrefix(dest, "/"),
 			Mode: cpio.FileMode(fi.Mode().Perm()) | cpio.ModeSymlink,
 			Size: int64(len(linkTarget)),
 		}
-		if err := img.out.WriteHeader(hdr); err != nil {
-			return fmt.Errorf("AppendFile: %v", err)
+		if err := img.writeEntry(hdr, []byte(linkTarget)); err != nil {
+			return fmt.Errorf("AppendFileFS: %v", err)
 		}
-		if _, err := img.out.Write([]byte(linkTarget)); err != nil {
-			return fmt.Errorf("AppendFile: %v", err)
-		}
-		img.contains[fn] = true
+		img.contains[dest] = true
 
-		// now add the link target as well
-		linkTarget, err = filepath.Abs(linkTarget)
-		if err != nil {
-			return fmt.Errorf("AppendFile: %v", err)
+		// now add the link target as well, resolved relative to its own
+		// directory rather than dest's, same as the real loader would
+		if !path.IsAbs(linkTarget) {
+			linkTarget = path.Join(path.Dir(src), linkTarget)
 		}
-		if err := img.AppendFile(linkTarget); err != nil {
-			return fmt.Errorf("AppendFile: %v", err)
+		if err := img.AppendFileFS(fsys, linkTarget, linkTarget); err != nil {
+			return fmt.Errorf("AppendFileFS: %v", err)
 		}
 	} else {
-		// file
-		content, err := ioutil.ReadFile(fn)
+		f, err := fsys.Open(src)
+		if err != nil {
+			return fmt.Errorf("AppendFileFS: %v", err)
+		}
+		content, err := ioutil.ReadAll(f)
+		f.Close()
 		if err != nil {
-			return fmt.Errorf("AppendFile: %v", err)
+			return fmt.Errorf("AppendFileFS: %v", err)
 		}
 
-		if err := img.AppendContent(content, fi.Mode().Perm(), fn); err != nil {
-			return fmt.Errorf("AppendFile: %v", err)
+		if err := img.AppendContentFS(fsys, content, fi.Mode().Perm(), dest); err != nil {
+			return fmt.Errorf("AppendFileFS: %v", err)
 		}
 	}
 
@@ -195,10 +266,11 @@ func elfSectionContent(s *elf.Section) (string, error) {
 	return string(b[:bytes.IndexByte(b, '\x00')]), nil
 }
 
-func (img *Image) AppendElfDependencies(ef *elf.File) error {
-	// TODO: use ef.DynString(elf.DT_RPATH) to calculate path to the loaded library
-	// or maybe we can parse /etc/ld.so.cache to get location for all libs?
-
+// AppendElfDependencies resolves and appends the shared libraries ef
+// imports, plus its ELF interpreter (if any), reading them from fsys.
+// originDir is the directory the file being added lives in, used to
+// expand an $ORIGIN found in DT_RPATH/DT_RUNPATH.
+func (img *Image) AppendElfDependencies(fsys FS, ef *elf.File, originDir string) error {
 	libs, err := ef.ImportedLibraries()
 	if err != nil {
 		return fmt.Errorf("AppendElfDependencies: %v", err)
@@ -215,12 +287,15 @@ func (img *Image) AppendElfDependencies(ef *elf.File) error {
 
 	for _, p := range libs {
 		if !filepath.IsAbs(p) {
-			p = filepath.Join("/usr/lib", p)
+			resolved, err := resolveLibrary(fsys, ef, p, originDir)
+			if err != nil {
+				return fmt.Errorf("AppendElfDependencies: %v", err)
+			}
+			p = resolved
 		}
-		err := img.AppendFile(p)
-		if err != nil {
+		if err := img.AppendFileFS(fsys, p, p); err != nil {
 			return fmt.Errorf("AppendElfDependencies: %v", err)
 		}
 	}
 	return nil
-}
\ No newline at end of file
+}
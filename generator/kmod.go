@@ -0,0 +1,270 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+)
+
+// modulesDep maps a module's path, relative to /lib/modules/<kver>/ (e.g.
+// "kernel/fs/ext4/ext4.ko.zst"), to the paths of the modules it depends on,
+// as recorded in modules.dep.
+type modulesDep map[string][]string
+
+func moduleDir(kver string) string {
+	return filepath.Join("/lib/modules", kver)
+}
+
+// parseModulesDep parses /lib/modules/<kver>/modules.dep, read from fsys.
+func parseModulesDep(fsys FS, kver string) (modulesDep, error) {
+	fn := filepath.Join(moduleDir(kver), "modules.dep")
+	f, err := fsys.Open(fn)
+	if err != nil {
+		return nil, fmt.Errorf("parseModulesDep: %v", err)
+	}
+	defer f.Close()
+
+	deps, err := parseModulesDepReader(f)
+	if err != nil {
+		return nil, fmt.Errorf("parseModulesDep: %v", err)
+	}
+	return deps, nil
+}
+
+// parseModulesDepReader is the pure parser parseModulesDep delegates to,
+// split out so the modules.dep line format can be exercised with an
+// in-memory fixture rather than a file under /lib/modules.
+func parseModulesDepReader(r io.Reader) (modulesDep, error) {
+	deps := make(modulesDep)
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		mod, rest, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+		deps[strings.TrimSpace(mod)] = strings.Fields(rest)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return deps, nil
+}
+
+// parseModulesBuiltin returns the set of module paths compiled directly
+// into the kernel -- these need no .ko file, modprobe considers them
+// already loaded. Absence of the file is not an error: some distro
+// kernels ship without one.
+func parseModulesBuiltin(fsys FS, kver string) (map[string]bool, error) {
+	f, err := fsys.Open(filepath.Join(moduleDir(kver), "modules.builtin"))
+	if os.IsNotExist(err) {
+		return map[string]bool{}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("parseModulesBuiltin: %v", err)
+	}
+	defer f.Close()
+	content, err := ioutil.ReadAll(f)
+	if err != nil {
+		return nil, fmt.Errorf("parseModulesBuiltin: %v", err)
+	}
+
+	builtin := make(map[string]bool)
+	for _, line := range strings.Split(string(content), "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			builtin[line] = true
+		}
+	}
+	return builtin, nil
+}
+
+// moduleNameToPath finds the modules.dep path for a bare module name (e.g.
+// "ext4"; dashes and underscores are interchangeable, same as modprobe).
+func moduleNameToPath(deps modulesDep, name string) (string, bool) {
+	normalize := func(s string) string { return strings.ReplaceAll(s, "-", "_") }
+
+	target := normalize(name)
+	for p := range deps {
+		base := path.Base(p)
+		base = strings.TrimSuffix(base, ".zst")
+		base = strings.TrimSuffix(base, ".xz")
+		base = strings.TrimSuffix(base, ".ko")
+		if normalize(base) == target {
+			return p, true
+		}
+	}
+	return "", false
+}
+
+// resolveModulePath accepts either a bare module name or an explicit
+// .ko/.ko.zst/.ko.xz path -- relative to /lib/modules/<kver>/ (e.g.
+// "kernel/fs/ext4/ext4.ko.zst") or a full on-disk path (e.g.
+// "/lib/modules/5.10.0/kernel/fs/ext4/ext4.ko.zst") -- and returns the
+// path relative to /lib/modules/<kver>/ that modules.dep indexes it under.
+func resolveModulePath(deps modulesDep, kver, name string) (string, error) {
+	if strings.HasSuffix(name, ".ko") || strings.HasSuffix(name, ".ko.zst") || strings.HasSuffix(name, ".ko.xz") {
+		if rel := strings.TrimPrefix(name, moduleDir(kver)); rel != name {
+			return strings.TrimPrefix(rel, "/"), nil
+		}
+		return strings.TrimPrefix(name, "/"), nil
+	}
+	if p, ok := moduleNameToPath(deps, name); ok {
+		return p, nil
+	}
+	return "", fmt.Errorf("resolveModulePath: module %q not found", name)
+}
+
+// readModuleFile reads fn from fsys, decompressing it first if its
+// extension indicates it is stored as .ko.zst, .ko.xz or .ko.gz.
+func readModuleFile(fsys FS, fn string) ([]byte, error) {
+	f, err := fsys.Open(fn)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	switch {
+	case strings.HasSuffix(fn, ".zst"):
+		zr, err := zstd.NewReader(f)
+		if err != nil {
+			return nil, err
+		}
+		defer zr.Close()
+		return ioutil.ReadAll(zr)
+	case strings.HasSuffix(fn, ".xz"):
+		xr, err := xz.NewReader(f)
+		if err != nil {
+			return nil, err
+		}
+		return ioutil.ReadAll(xr)
+	case strings.HasSuffix(fn, ".gz"):
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			return nil, err
+		}
+		defer gz.Close()
+		return ioutil.ReadAll(gz)
+	default:
+		return ioutil.ReadAll(f)
+	}
+}
+
+// decompressedModuleName strips a module's on-disk compression suffix,
+// e.g. "kernel/fs/ext4/ext4.ko.zst" -> "kernel/fs/ext4/ext4.ko".
+func decompressedModuleName(p string) string {
+	p = strings.TrimSuffix(p, ".zst")
+	p = strings.TrimSuffix(p, ".xz")
+	p = strings.TrimSuffix(p, ".gz")
+	return p
+}
+
+// AppendKernelModule appends a single kernel module, by bare name (e.g.
+// "ext4") or by .ko/.ko.zst/.ko.xz path, plus every module it transitively
+// depends on, reading modules.dep and the modules themselves from the live
+// root filesystem. See AppendModuleSet and AppendKernelModuleFS.
+func (img *Image) AppendKernelModule(name, kver string) error {
+	return img.AppendKernelModuleFS(osFS{}, name, kver)
+}
+
+// AppendKernelModuleFS is like AppendKernelModule, but sources
+// modules.dep, modules.builtin and the modules themselves from fsys
+// instead of the live root filesystem -- e.g. a cross-built staging
+// directory (DirFS) or a container image layer (TarLayerFS).
+func (img *Image) AppendKernelModuleFS(fsys FS, name, kver string) error {
+	return img.AppendModuleSetFS(fsys, kver, []string{name})
+}
+
+// AppendModuleSet resolves names (bare module names or .ko/.ko.zst/.ko.xz
+// paths) against /lib/modules/<kver>/modules.dep, transitively pulls in
+// every dependency, decompressing on the fly when a module is stored
+// compressed, and also copies modules.dep.bin, modules.alias.bin and
+// modules.symbols.bin so modprobe works inside the initramfs. Everything
+// is read from the live root filesystem; see AppendModuleSetFS to source
+// a foreign root instead.
+func (img *Image) AppendModuleSet(kver string, names []string) error {
+	return img.AppendModuleSetFS(osFS{}, kver, names)
+}
+
+// AppendModuleSetFS is like AppendModuleSet, but sources modules.dep,
+// modules.builtin and the modules themselves from fsys instead of the
+// live root filesystem.
+func (img *Image) AppendModuleSetFS(fsys FS, kver string, names []string) error {
+	deps, err := parseModulesDep(fsys, kver)
+	if err != nil {
+		return fmt.Errorf("AppendModuleSet: %v", err)
+	}
+	builtin, err := parseModulesBuiltin(fsys, kver)
+	if err != nil {
+		return fmt.Errorf("AppendModuleSet: %v", err)
+	}
+
+	var queue []string
+	for _, n := range names {
+		p, err := resolveModulePath(deps, kver, n)
+		if err != nil {
+			return fmt.Errorf("AppendModuleSet: %v", err)
+		}
+		queue = append(queue, p)
+	}
+
+	dir := moduleDir(kver)
+	for len(queue) > 0 {
+		p := queue[0]
+		queue = queue[1:]
+		if builtin[p] {
+			continue
+		}
+
+		// Image.contains is keyed by destination path and already tracks
+		// every module added so far, including ones added by an earlier
+		// AppendKernelModule/AppendModuleSet call on the same Image -- reuse
+		// it instead of a call-local set, the same way AppendDir treats a
+		// repeat directory as a no-op rather than an error. Sharing
+		// dependencies (e.g. ext4 and xfs both pulling in crc32c) is the
+		// common case, not an edge case.
+		dest := filepath.Join(dir, decompressedModuleName(p))
+		if img.contains[dest] {
+			continue
+		}
+
+		src := filepath.Join(dir, p)
+		fi, err := fsys.Lstat(src)
+		if err != nil {
+			return fmt.Errorf("AppendModuleSet: %s: %v", p, err)
+		}
+		content, err := readModuleFile(fsys, src)
+		if err != nil {
+			return fmt.Errorf("AppendModuleSet: %s: %v", p, err)
+		}
+
+		if err := img.AppendContentFS(fsys, content, fi.Mode().Perm(), dest); err != nil {
+			return fmt.Errorf("AppendModuleSet: %s: %v", p, err)
+		}
+
+		queue = append(queue, deps[p]...)
+	}
+
+	for _, idx := range []string{"modules.dep.bin", "modules.alias.bin", "modules.symbols.bin"} {
+		dest := filepath.Join(dir, idx)
+		if img.contains[dest] {
+			continue
+		}
+		if err := img.AppendFileFS(fsys, dest, dest); err != nil {
+			return fmt.Errorf("AppendModuleSet: %v", err)
+		}
+	}
+	return nil
+}
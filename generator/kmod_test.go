@@ -0,0 +1,188 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestParseModulesDepReader(t *testing.T) {
+	const fixture = `
+kernel/lib/crc32c.ko.zst:
+kernel/lib/libcrc32c.ko.zst: kernel/lib/crc32c.ko.zst
+kernel/fs/ext4/ext4.ko.zst: kernel/lib/crc32c.ko.zst kernel/fs/jbd2/jbd2.ko.zst
+kernel/fs/jbd2/jbd2.ko.zst: kernel/lib/crc32c.ko.zst
+`
+	deps, err := parseModulesDepReader(strings.NewReader(fixture))
+	if err != nil {
+		t.Fatalf("parseModulesDepReader: %v", err)
+	}
+
+	want := map[string][]string{
+		"kernel/lib/crc32c.ko.zst":    nil,
+		"kernel/lib/libcrc32c.ko.zst": {"kernel/lib/crc32c.ko.zst"},
+		"kernel/fs/ext4/ext4.ko.zst":  {"kernel/lib/crc32c.ko.zst", "kernel/fs/jbd2/jbd2.ko.zst"},
+		"kernel/fs/jbd2/jbd2.ko.zst":  {"kernel/lib/crc32c.ko.zst"},
+	}
+	if len(deps) != len(want) {
+		t.Fatalf("got %d modules, want %d: %v", len(deps), len(want), deps)
+	}
+	for mod, wantDeps := range want {
+		if got := deps[mod]; !(len(got) == 0 && len(wantDeps) == 0) && !reflect.DeepEqual(got, wantDeps) {
+			t.Errorf("deps[%q] = %v, want %v", mod, got, wantDeps)
+		}
+	}
+}
+
+func TestModuleNameToPath(t *testing.T) {
+	deps := modulesDep{
+		"kernel/fs/ext4/ext4.ko.zst":      {"kernel/lib/crc32c.ko.zst"},
+		"kernel/drivers/md/dm_mod.ko.zst": nil,
+	}
+
+	for _, name := range []string{"ext4"} {
+		p, ok := moduleNameToPath(deps, name)
+		if !ok || p != "kernel/fs/ext4/ext4.ko.zst" {
+			t.Errorf("moduleNameToPath(%q) = %q, %v; want kernel/fs/ext4/ext4.ko.zst, true", name, p, ok)
+		}
+	}
+
+	// dashes and underscores are interchangeable, same as modprobe.
+	for _, name := range []string{"dm_mod", "dm-mod"} {
+		p, ok := moduleNameToPath(deps, name)
+		if !ok || p != "kernel/drivers/md/dm_mod.ko.zst" {
+			t.Errorf("moduleNameToPath(%q) = %q, %v; want kernel/drivers/md/dm_mod.ko.zst, true", name, p, ok)
+		}
+	}
+
+	if _, ok := moduleNameToPath(deps, "xfs"); ok {
+		t.Error("moduleNameToPath(xfs) unexpectedly found a module")
+	}
+}
+
+func TestResolveModulePath(t *testing.T) {
+	deps := modulesDep{
+		"kernel/fs/ext4/ext4.ko.zst": nil,
+	}
+	const kver = "5.10.0"
+
+	cases := []struct {
+		name string
+		want string
+	}{
+		{"ext4", "kernel/fs/ext4/ext4.ko.zst"},
+		{"kernel/fs/ext4/ext4.ko.zst", "kernel/fs/ext4/ext4.ko.zst"},
+		{"/lib/modules/5.10.0/kernel/fs/ext4/ext4.ko.zst", "kernel/fs/ext4/ext4.ko.zst"},
+	}
+	for _, c := range cases {
+		got, err := resolveModulePath(deps, kver, c.name)
+		if err != nil {
+			t.Errorf("resolveModulePath(%q): %v", c.name, err)
+			continue
+		}
+		if got != c.want {
+			t.Errorf("resolveModulePath(%q) = %q, want %q", c.name, got, c.want)
+		}
+	}
+
+	if _, err := resolveModulePath(deps, kver, "nonexistent"); err == nil {
+		t.Error("resolveModulePath(nonexistent) unexpectedly succeeded")
+	}
+}
+
+// walkDeps replicates AppendModuleSet's breadth-first transitive-closure
+// walk over modulesDep, without the filesystem/cpio side effects, so the
+// set of modules reached and the dedup behavior can be tested directly.
+// The result is sorted, so it does not reflect the walk order.
+func walkDeps(deps modulesDep, roots []string) []string {
+	seen := map[string]bool{}
+	var order []string
+	queue := append([]string{}, roots...)
+	for len(queue) > 0 {
+		p := queue[0]
+		queue = queue[1:]
+		if seen[p] {
+			continue
+		}
+		seen[p] = true
+		order = append(order, p)
+		queue = append(queue, deps[p]...)
+	}
+	sort.Strings(order)
+	return order
+}
+
+func TestWalkDepsTransitiveClosure(t *testing.T) {
+	deps := modulesDep{
+		"kernel/lib/crc32c.ko.zst":   nil,
+		"kernel/fs/jbd2/jbd2.ko.zst": {"kernel/lib/crc32c.ko.zst"},
+		"kernel/fs/ext4/ext4.ko.zst": {"kernel/lib/crc32c.ko.zst", "kernel/fs/jbd2/jbd2.ko.zst"},
+	}
+
+	got := walkDeps(deps, []string{"kernel/fs/ext4/ext4.ko.zst"})
+	want := []string{
+		"kernel/fs/ext4/ext4.ko.zst",
+		"kernel/fs/jbd2/jbd2.ko.zst",
+		"kernel/lib/crc32c.ko.zst",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("walkDeps = %v, want %v", got, want)
+	}
+}
+
+// TestAppendModuleSetFSFromForeignRoot builds a fake /lib/modules tree
+// under a staging directory and appends from it via DirFS, exercising the
+// same foreign-root path a cross-built staging directory or a
+// TarLayerFS-backed OCI layer would take -- not the live root filesystem
+// AppendModuleSet uses.
+func TestAppendModuleSetFSFromForeignRoot(t *testing.T) {
+	const kver = "5.10.0"
+	root := t.TempDir()
+	modDir := filepath.Join(root, "lib", "modules", kver, "kernel", "lib")
+	if err := os.MkdirAll(modDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	write := func(rel string, content []byte) {
+		fn := filepath.Join(root, "lib", "modules", kver, rel)
+		if err := os.MkdirAll(filepath.Dir(fn), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(fn, content, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	write("modules.dep", []byte("kernel/lib/crc32c.ko:\n"))
+	write("modules.builtin", nil)
+	write("kernel/lib/crc32c.ko", []byte("fake module content"))
+	write("modules.dep.bin", []byte("dep bin"))
+	write("modules.alias.bin", []byte("alias bin"))
+	write("modules.symbols.bin", []byte("symbols bin"))
+
+	imgPath := filepath.Join(t.TempDir(), "image.cpio")
+	img, err := NewImage(imgPath, WithCompression(CompressionNone))
+	if err != nil {
+		t.Fatalf("NewImage: %v", err)
+	}
+	defer img.Cleanup()
+
+	if err := img.AppendModuleSetFS(DirFS(root), kver, []string{"crc32c"}); err != nil {
+		t.Fatalf("AppendModuleSetFS: %v", err)
+	}
+
+	moduleDest := filepath.Join(moduleDir(kver), "kernel/lib/crc32c.ko")
+	if !img.contains[moduleDest] {
+		t.Errorf("image does not contain %s", moduleDest)
+	}
+	for _, idx := range []string{"modules.dep.bin", "modules.alias.bin", "modules.symbols.bin"} {
+		dest := filepath.Join(moduleDir(kver), idx)
+		if !img.contains[dest] {
+			t.Errorf("image does not contain %s", dest)
+		}
+	}
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bytes"
+	"debug/elf"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+// standardLibDirs is consulted as a last resort, if a library cannot be
+// resolved via DT_RPATH/DT_RUNPATH, LD_LIBRARY_PATH or /etc/ld.so.cache.
+var standardLibDirs = []string{"/lib", "/usr/lib", "/lib64", "/usr/lib64"}
+
+// ldSoCache maps a SONAME (e.g. "libc.so.6") to the absolute path glibc's
+// dynamic linker would load it from, as recorded in /etc/ld.so.cache.
+type ldSoCache map[string]string
+
+// cachedLdSoCache memoizes /etc/ld.so.cache for the osFS fast path (the
+// common case of building from the live root). Foreign roots (DirFS,
+// TarLayerFS) are parsed fresh every time since they're not expected to be
+// reused across many images the way the live root is.
+var cachedLdSoCache ldSoCache
+
+// loadLdSoCacheFS parses fsys's /etc/ld.so.cache. A missing or
+// unrecognized cache (e.g. on a musl-based build host) is not fatal,
+// callers just fall back to rpath and the standard library directories.
+func loadLdSoCacheFS(fsys FS) ldSoCache {
+	_, isOSFS := fsys.(osFS)
+	if isOSFS && cachedLdSoCache != nil {
+		return cachedLdSoCache
+	}
+
+	cache, err := parseLdSoCache(fsys, "/etc/ld.so.cache")
+	if err != nil {
+		cache = ldSoCache{}
+	}
+	if isOSFS {
+		cachedLdSoCache = cache
+	}
+	return cache
+}
+
+// parseLdSoCache decodes the glibc ld.so.cache binary format: a legacy
+// "ld.so-1.7.0" header/entry table (kept around for backwards compat with
+// old tools) followed by the "glibc-ld.so.cache1.1" table that is what
+// ld.so actually consults. See glibc's sysdeps/generic/dl-cache.h for the
+// authoritative struct layout.
+func parseLdSoCache(fsys FS, fn string) (ldSoCache, error) {
+	f, err := fsys.Open(fn)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	data, err := ioutil.ReadAll(f)
+	if err != nil {
+		return nil, err
+	}
+	return parseLdSoCacheBytes(fn, data)
+}
+
+// parseLdSoCacheBytes is the pure decoder parseLdSoCache delegates to,
+// split out so it can be exercised with an in-memory fixture rather than a
+// file on disk.
+func parseLdSoCacheBytes(fn string, data []byte) (ldSoCache, error) {
+	const (
+		oldMagic      = "ld.so-1.7.0"
+		oldHeaderSize = 16 // magic[11] padded to 4-byte alignment, then uint32 nlibs
+		oldEntrySize  = 12
+		newMagic      = "glibc-ld.so.cache1.1"
+		newHeaderSize = 48
+		newEntrySize  = 24
+	)
+
+	if !bytes.HasPrefix(data, []byte(oldMagic)) || len(data) < oldHeaderSize {
+		return nil, fmt.Errorf("parseLdSoCache: %s: unrecognized header", fn)
+	}
+	oldNlibs := binary.LittleEndian.Uint32(data[12:16])
+	newOff := oldHeaderSize + int(oldNlibs)*oldEntrySize
+
+	if newOff+len(newMagic) > len(data) || string(data[newOff:newOff+len(newMagic)]) != newMagic {
+		return nil, fmt.Errorf("parseLdSoCache: %s: unrecognized new-format header", fn)
+	}
+	nlibs := binary.LittleEndian.Uint32(data[newOff+20 : newOff+24])
+
+	cache := make(ldSoCache, nlibs)
+	for i := uint32(0); i < nlibs; i++ {
+		eoff := newOff + newHeaderSize + int(i)*newEntrySize
+		if eoff+newEntrySize > len(data) {
+			break
+		}
+		keyOff := binary.LittleEndian.Uint32(data[eoff+4 : eoff+8])
+		valOff := binary.LittleEndian.Uint32(data[eoff+8 : eoff+12])
+		key := cString(data[newOff+int(keyOff):])
+		val := cString(data[newOff+int(valOff):])
+		// keep the first (highest-priority) match, ld.so.cache lists
+		// entries most-specific-hwcap-first
+		if _, ok := cache[key]; !ok {
+			cache[key] = val
+		}
+	}
+	return cache, nil
+}
+
+func cString(b []byte) string {
+	if i := bytes.IndexByte(b, 0); i >= 0 {
+		return string(b[:i])
+	}
+	return string(b)
+}
+
+// dynamicSearchPaths reads a colon-separated DT_RPATH/DT_RUNPATH tag and
+// expands the dynamic string tokens ($ORIGIN, $LIB, $PLATFORM) each entry
+// may contain.
+func dynamicSearchPaths(ef *elf.File, tag elf.DynTag, originDir string) []string {
+	raw, err := ef.DynString(tag)
+	if err != nil || len(raw) == 0 {
+		return nil
+	}
+
+	var dirs []string
+	for _, entry := range raw {
+		for _, dir := range strings.Split(entry, ":") {
+			if dir == "" {
+				continue
+			}
+			dirs = append(dirs, expandDynamicStringToken(ef, dir, originDir))
+		}
+	}
+	return dirs
+}
+
+// expandDynamicStringToken expands the $ORIGIN, $LIB and $PLATFORM tokens
+// glibc recognizes inside DT_RPATH/DT_RUNPATH/DT_NEEDED entries.
+func expandDynamicStringToken(ef *elf.File, dir, originDir string) string {
+	lib := "lib64"
+	if ef.Class == elf.ELFCLASS32 {
+		lib = "lib"
+	}
+
+	replacements := []string{
+		"$ORIGIN", originDir, "${ORIGIN}", originDir,
+		"$LIB", lib, "${LIB}", lib,
+		"$PLATFORM", runtime.GOARCH, "${PLATFORM}", runtime.GOARCH,
+	}
+	return strings.NewReplacer(replacements...).Replace(dir)
+}
+
+// resolveLibrary finds the absolute path for soname, within fsys, the way
+// the dynamic linker would: DT_RPATH, then LD_LIBRARY_PATH, then
+// DT_RUNPATH, then /etc/ld.so.cache, then the standard library
+// directories.
+func resolveLibrary(fsys FS, ef *elf.File, soname, originDir string) (string, error) {
+	for _, dir := range dynamicSearchPaths(ef, elf.DT_RPATH, originDir) {
+		if p := filepath.Join(dir, soname); fsExists(fsys, p) {
+			return p, nil
+		}
+	}
+
+	for _, dir := range filepath.SplitList(os.Getenv("LD_LIBRARY_PATH")) {
+		if dir == "" {
+			continue
+		}
+		if p := filepath.Join(dir, soname); fsExists(fsys, p) {
+			return p, nil
+		}
+	}
+
+	for _, dir := range dynamicSearchPaths(ef, elf.DT_RUNPATH, originDir) {
+		if p := filepath.Join(dir, soname); fsExists(fsys, p) {
+			return p, nil
+		}
+	}
+
+	if p, ok := loadLdSoCacheFS(fsys)[soname]; ok {
+		return p, nil
+	}
+
+	for _, dir := range standardLibDirs {
+		if p := filepath.Join(dir, soname); fsExists(fsys, p) {
+			return p, nil
+		}
+	}
+
+	return "", fmt.Errorf("resolveLibrary: unable to locate %s", soname)
+}
+
+func fsExists(fsys FS, p string) bool {
+	_, err := fsys.Lstat(p)
+	return err == nil
+}
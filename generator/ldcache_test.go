@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+// buildLdSoCacheFixture hand-assembles a minimal glibc ld.so.cache: an
+// empty legacy "ld.so-1.7.0" table followed by the "glibc-ld.so.cache1.1"
+// table parseLdSoCache actually reads entries from.
+func buildLdSoCacheFixture(t *testing.T, entries [][2]string) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+
+	// legacy header: magic, padding to 4-byte alignment, then nlibs=0 and
+	// no legacy entries.
+	buf.WriteString("ld.so-1.7.0")
+	buf.WriteByte(0)
+	binary.Write(&buf, binary.LittleEndian, uint32(0))
+
+	newOff := buf.Len()
+
+	const newMagic = "glibc-ld.so.cache1.1"
+	buf.WriteString(newMagic)
+	binary.Write(&buf, binary.LittleEndian, uint32(len(entries))) // nlibs at newOff+20
+	// pad the rest of the 48-byte new header (len_strings, unused[]).
+	for buf.Len() < newOff+48 {
+		buf.WriteByte(0)
+	}
+
+	// string table lives right after the entry table; reserve the entry
+	// table space first and fill it in once string offsets are known.
+	entryTableOff := buf.Len()
+	buf.Write(make([]byte, len(entries)*24))
+	stringsOff := buf.Len() - newOff
+
+	entryTable := buf.Bytes()[entryTableOff : entryTableOff+len(entries)*24]
+	var strs bytes.Buffer
+	for i, e := range entries {
+		keyOff := stringsOff + strs.Len()
+		strs.WriteString(e[0])
+		strs.WriteByte(0)
+		valOff := stringsOff + strs.Len()
+		strs.WriteString(e[1])
+		strs.WriteByte(0)
+
+		eoff := i * 24
+		binary.LittleEndian.PutUint32(entryTable[eoff:], 0) // flags
+		binary.LittleEndian.PutUint32(entryTable[eoff+4:], uint32(keyOff))
+		binary.LittleEndian.PutUint32(entryTable[eoff+8:], uint32(valOff))
+	}
+	buf.Write(strs.Bytes())
+
+	return buf.Bytes()
+}
+
+func TestParseLdSoCacheBytes(t *testing.T) {
+	data := buildLdSoCacheFixture(t, [][2]string{
+		{"libc.so.6", "/lib/x86_64-linux-gnu/libc.so.6"},
+		{"libm.so.6", "/lib/x86_64-linux-gnu/libm.so.6"},
+	})
+
+	cache, err := parseLdSoCacheBytes("ld.so.cache", data)
+	if err != nil {
+		t.Fatalf("parseLdSoCacheBytes: %v", err)
+	}
+
+	want := map[string]string{
+		"libc.so.6": "/lib/x86_64-linux-gnu/libc.so.6",
+		"libm.so.6": "/lib/x86_64-linux-gnu/libm.so.6",
+	}
+	if len(cache) != len(want) {
+		t.Fatalf("got %d entries, want %d: %v", len(cache), len(want), cache)
+	}
+	for k, v := range want {
+		if cache[k] != v {
+			t.Errorf("cache[%q] = %q, want %q", k, cache[k], v)
+		}
+	}
+}
+
+func TestParseLdSoCacheBytesKeepsFirstMatch(t *testing.T) {
+	// ld.so.cache lists entries most-specific-hwcap-first; the parser must
+	// keep the first match for a given SONAME rather than the last.
+	data := buildLdSoCacheFixture(t, [][2]string{
+		{"libc.so.6", "/lib/hwcap/libc.so.6"},
+		{"libc.so.6", "/lib/libc.so.6"},
+	})
+
+	cache, err := parseLdSoCacheBytes("ld.so.cache", data)
+	if err != nil {
+		t.Fatalf("parseLdSoCacheBytes: %v", err)
+	}
+	if got := cache["libc.so.6"]; got != "/lib/hwcap/libc.so.6" {
+		t.Errorf("cache[libc.so.6] = %q, want first entry /lib/hwcap/libc.so.6", got)
+	}
+}
+
+func TestParseLdSoCacheBytesRejectsBadMagic(t *testing.T) {
+	if _, err := parseLdSoCacheBytes("ld.so.cache", []byte("not a cache file")); err == nil {
+		t.Fatal("expected an error for an unrecognized header, got nil")
+	}
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"sort"
+
+	"github.com/cavaliercoder/go-cpio"
+)
+
+// pendingEntry buffers a single cpio entry while in Reproducible mode, so
+// Close can restamp, sort and assign inode numbers before anything is
+// written to the archive.
+type pendingEntry struct {
+	hdr     cpio.Header
+	content []byte
+}
+
+// writeEntry emits hdr+content to the cpio archive, or -- in Reproducible
+// mode -- stamps hdr with the fixed mtime/uid/gid and buffers the entry
+// for flushReproducible to sort and write out at Close.
+func (img *Image) writeEntry(hdr *cpio.Header, content []byte) error {
+	if !img.reproducible {
+		if err := img.out.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if len(content) > 0 {
+			if _, err := img.out.Write(content); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	hdr.ModTime = img.sourceDateEpoch
+	hdr.Uid = 0
+	hdr.Guid = 0
+	img.pending = append(img.pending, pendingEntry{hdr: *hdr, content: content})
+	return nil
+}
+
+// flushReproducible sorts the buffered entries lexicographically by name,
+// assigns monotonically increasing inode numbers and writes them out. This,
+// together with the fixed mtime/uid/gid set in writeEntry and the
+// single-threaded zstd encoding forced in newCompressor, is what makes two
+// runs of booster over the same inputs produce a byte-identical image --
+// the same technique Debian/Arch use for reproducible initramfs.
+func (img *Image) flushReproducible() error {
+	sort.Slice(img.pending, func(i, j int) bool {
+		return img.pending[i].hdr.Name < img.pending[j].hdr.Name
+	})
+
+	for i := range img.pending {
+		e := &img.pending[i]
+		e.hdr.Inode = int64(i) + 1
+		if err := img.out.WriteHeader(&e.hdr); err != nil {
+			return err
+		}
+		if len(e.content) > 0 {
+			if _, err := img.out.Write(e.content); err != nil {
+				return err
+			}
+		}
+	}
+	img.pending = nil
+	return nil
+}
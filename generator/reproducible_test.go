@@ -0,0 +1,86 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/cavaliercoder/go-cpio"
+)
+
+func TestReproducibleOrdersStampsAndNumbersInodes(t *testing.T) {
+	epoch := time.Unix(1700000000, 0).UTC()
+	path := filepath.Join(t.TempDir(), "image.cpio")
+
+	img, err := NewImage(path, WithCompression(CompressionNone), WithReproducible(epoch))
+	if err != nil {
+		t.Fatalf("NewImage: %v", err)
+	}
+
+	// write out of lexicographic order, with non-zero uid/gid/mtime, to
+	// make sure flushReproducible actually normalizes them rather than
+	// happening to already be right.
+	for _, name := range []string{"c", "a", "b"} {
+		hdr := &cpio.Header{
+			Name:    name,
+			Mode:    cpio.FileMode(0644) | cpio.ModeRegular,
+			ModTime: time.Unix(1234, 0),
+			Uid:     1000,
+			Guid:    1000,
+			Size:    int64(len(name)),
+		}
+		if err := img.writeEntry(hdr, []byte(name)); err != nil {
+			t.Fatalf("writeEntry(%s): %v", name, err)
+		}
+	}
+
+	if err := img.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := cpio.NewReader(bytes.NewReader(content))
+	var gotNames []string
+	var gotInodes []int64
+	for {
+		hdr, err := r.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("cpio read: %v", err)
+		}
+		if hdr.Name == "TRAILER!!!" {
+			break
+		}
+		gotNames = append(gotNames, hdr.Name)
+		gotInodes = append(gotInodes, hdr.Inode)
+
+		if !hdr.ModTime.Equal(epoch) {
+			t.Errorf("%s: ModTime = %v, want %v", hdr.Name, hdr.ModTime, epoch)
+		}
+		if hdr.Uid != 0 || hdr.Guid != 0 {
+			t.Errorf("%s: Uid/Guid = %d/%d, want 0/0", hdr.Name, hdr.Uid, hdr.Guid)
+		}
+	}
+
+	wantNames := []string{"a", "b", "c"}
+	if len(gotNames) != len(wantNames) {
+		t.Fatalf("got names %v, want %v", gotNames, wantNames)
+	}
+	for i, name := range wantNames {
+		if gotNames[i] != name {
+			t.Errorf("entry %d name = %q, want %q", i, gotNames[i], name)
+		}
+		if gotInodes[i] != int64(i)+1 {
+			t.Errorf("entry %d inode = %d, want %d", i, gotInodes[i], i+1)
+		}
+	}
+}